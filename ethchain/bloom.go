@@ -0,0 +1,65 @@
+package ethchain
+
+import "github.com/ethereum/eth-go/ethutil"
+
+// Bloom is the 2048 bit (256 byte) Bloom filter attached to each receipt and
+// OR'd together into a single filter per block, giving O(1) probabilistic
+// "does this block possibly contain logs for this address/topic" lookups.
+type Bloom [256]byte
+
+// CreateBloom builds the Bloom filter for a single receipt from the
+// addresses and topics of every Log it contains.
+func CreateBloom(receipt *Receipt) Bloom {
+	var bin Bloom
+	for _, log := range receipt.Logs {
+		bin.Or(bloom9(log.Address))
+		for _, topic := range log.Topics {
+			bin.Or(bloom9(topic))
+		}
+	}
+
+	return bin
+}
+
+// bloom9 computes the three bits a single address or topic contributes to a
+// Bloom filter: keccak256(item), then for each of the three 16 bit
+// big-endian words at offsets 0, 2 and 4, mask to 11 bits and set the
+// corresponding bit counting from the end of the filter.
+func bloom9(item []byte) Bloom {
+	var b Bloom
+
+	hash := ethutil.Sha3Bin(item)
+	for i := 0; i < 6; i += 2 {
+		v := (uint(hash[i]) << 8) | uint(hash[i+1])
+		v &= 0x7ff
+
+		b[256-1-v/8] |= 1 << (v % 8)
+	}
+
+	return b
+}
+
+// Test reports whether item (an address or topic) is possibly present in
+// the filter. A false result is definitive; true may be a false positive.
+func (self Bloom) Test(item []byte) bool {
+	return self.Has(bloom9(item))
+}
+
+// Has reports whether every bit set in other is also set in self, i.e.
+// whether other could have been OR'd into self.
+func (self Bloom) Has(other Bloom) bool {
+	for i := range other {
+		if other[i] != 0 && self[i]&other[i] != other[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Or sets every bit of other into self.
+func (self *Bloom) Or(other Bloom) {
+	for i := range other {
+		self[i] |= other[i]
+	}
+}
@@ -0,0 +1,101 @@
+package ethchain
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// ClosureRef is what an Execution needs from whoever is on the calling side
+// of a value transfer or contract invocation: just enough identity to look
+// the caller's account up in state.
+type ClosureRef interface {
+	Address() []byte
+}
+
+// Execution threads the value-transfer / gas-metered eval sequence a single
+// contract invocation needs, independent of whether it's driving the
+// top-level transaction or a CALL/CALLCODE opcode recursing out of the VM.
+// Lifting this out of StateTransition is what lets CALL opcodes recurse
+// with correct gas metering and rollback semantics: each nested call is
+// just another Execution against a different (sender, receiver, value,
+// input) tuple, sharing the outer gas pool.
+type Execution struct {
+	vm *Vm
+
+	address  []byte
+	input    []byte
+	gas      *big.Int
+	gasPrice *big.Int
+	value    *big.Int
+}
+
+func NewExecution(vm *Vm, address, input []byte, gas, gasPrice, value *big.Int) *Execution {
+	return &Execution{vm: vm, address: address, input: input, gas: gas, gasPrice: gasPrice, value: value}
+}
+
+// Call invokes the contract already living at self.address, passing
+// self.input as call data and transferring self.value from caller first.
+// A failure during the call reverts the transfer and any state the
+// contract touched.
+func (self *Execution) Call(caller ClosureRef) ([]byte, error) {
+	return self.exec(caller, self.address, false)
+}
+
+// Create deploys a new contract account at self.address, running
+// self.input as its initialisation code and using the return value as the
+// contract's script. A failing init reverts the transfer and the account
+// creation itself, leaving nothing half initialised behind.
+//
+// self.address is the caller's responsibility to derive (e.g.
+// tx.CreationAddress() for a top-level contract-creation transaction) and
+// hand to NewExecution; Execution itself no longer derives it from the
+// creating account's nonce, since by the time a nested Execution runs that
+// nonce has typically already been bumped by the caller, which would shift
+// the derived address off whatever scheme the caller actually used.
+func (self *Execution) Create(caller ClosureRef) ([]byte, error) {
+	return self.exec(caller, self.address, true)
+}
+
+func (self *Execution) exec(caller ClosureRef, address []byte, creation bool) (ret []byte, err error) {
+	state := self.vm.state
+
+	snapshot := state.Snapshot()
+	defer func() {
+		if err != nil {
+			state.RevertTo(snapshot)
+		}
+	}()
+
+	sender := state.GetAccount(caller.Address())
+	if sender.Amount.Cmp(self.value) < 0 {
+		return nil, fmt.Errorf("Insufficient funds to transfer value. Req %v, has %v", self.value, sender.Amount)
+	}
+
+	receiver := state.GetAccount(address)
+
+	sender.SubAmount(self.value)
+	receiver.AddAmount(self.value)
+
+	// Create runs self.input itself as the init code; Call runs whatever
+	// code the receiver already has on file, with self.input as the call's
+	// argument data instead.
+	code := self.input
+	if !creation {
+		code = receiver.script
+	}
+
+	closure := NewClosure(sender, receiver, code, state, self.gas, self.gasPrice)
+	ret, _, err = closure.Call(self.vm, self.input, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if creation {
+		receiver.script = ret
+	}
+
+	state.UpdateStateObject(sender)
+	state.UpdateStateObject(receiver)
+
+	return ret, nil
+}
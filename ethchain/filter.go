@@ -0,0 +1,299 @@
+package ethchain
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/ethereum/eth-go/ethreact"
+	"github.com/ethereum/eth-go/ethutil"
+)
+
+// BlockChain is the subset of chain access a Filter needs in order to walk
+// the range of blocks it's asked to search.
+type BlockChain interface {
+	GetBlockByNumber(number int64) *Block
+	LastBlockNumber() int64
+}
+
+// Filter matches Logs across a range of blocks by address and topic, using
+// each block's and receipt's Bloom filter to skip the ones that can't
+// possibly match before falling back to checking the Logs themselves.
+//
+// Topics is AND'd across positions; within a single position the list of
+// alternatives is OR'd, mirroring eth_newFilter's topics argument.
+type Filter struct {
+	Earliest  int64 // -1 means "pending/latest"
+	Latest    int64 // -1 means "latest"
+	Addresses [][]byte
+	Topics    [][][]byte
+	Max       int
+	Skip      int
+
+	chain BlockChain
+
+	mu     sync.Mutex
+	cached []*Log
+	dirty  bool
+
+	subs []ethreact.Subscription
+	quit chan struct{}
+}
+
+// NewFilter creates a Filter with no address/topic constraints, searching
+// only the latest block until its fields are set otherwise.
+func NewFilter(chain BlockChain) *Filter {
+	return &Filter{Earliest: -1, Latest: -1, chain: chain, dirty: true}
+}
+
+// NewFilterFromMap builds a Filter from the loosely typed field set a
+// JSON-RPC eth_newFilter-style call would hand us.
+func NewFilterFromMap(chain BlockChain, fields map[string]interface{}) *Filter {
+	filter := NewFilter(chain)
+
+	if v, ok := fields["earliest"]; ok {
+		filter.Earliest = toInt64(v, -1)
+	}
+	if v, ok := fields["latest"]; ok {
+		filter.Latest = toInt64(v, -1)
+	}
+	if v, ok := fields["max"]; ok {
+		filter.Max = int(toInt64(v, 0))
+	}
+	if v, ok := fields["skip"]; ok {
+		filter.Skip = int(toInt64(v, 0))
+	}
+	if v, ok := fields["address"]; ok {
+		filter.Addresses = toAddresses(v)
+	}
+	if v, ok := fields["topics"]; ok {
+		filter.Topics = toTopics(v)
+	}
+
+	return filter
+}
+
+// Listen subscribes the filter to newBlock/chainReorg events so a cached
+// Find() result is invalidated as soon as the chain it's watching changes,
+// instead of a pending filter silently returning stale matches.
+func (self *Filter) Listen(reactor *ethreact.Reactor) {
+	ch := make(chan ethreact.Event, 4)
+	self.quit = make(chan struct{})
+	self.subs = []ethreact.Subscription{
+		reactor.Subscribe("newBlock", ch),
+		reactor.Subscribe("chainReorg", ch),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ch:
+				self.mu.Lock()
+				self.dirty = true
+				self.mu.Unlock()
+			case <-self.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops listening for chain events. Safe to call on a Filter that
+// never had Listen called on it.
+func (self *Filter) Close() {
+	for _, sub := range self.subs {
+		sub.Unsubscribe()
+	}
+	if self.quit != nil {
+		close(self.quit)
+	}
+}
+
+// Find walks blocks [Earliest, Latest] newest-first (Latest == -1 meaning
+// the current chain head) and returns every Log matching the filter's
+// addresses and topics, after skipping the first Skip matches and limiting
+// to Max results (Max == 0 means unlimited).
+func (self *Filter) Find() []*Log {
+	self.mu.Lock()
+	if !self.dirty && self.cached != nil {
+		cached := self.cached
+		self.mu.Unlock()
+		return cached
+	}
+	self.mu.Unlock()
+
+	latest := self.Latest
+	if latest < 0 {
+		latest = self.chain.LastBlockNumber()
+	}
+	earliest := self.Earliest
+	if earliest < 0 {
+		earliest = latest
+	}
+
+	var logs []*Log
+	skipped := 0
+	for num := latest; num >= earliest; num-- {
+		block := self.chain.GetBlockByNumber(num)
+		if block == nil {
+			continue
+		}
+
+		if !self.matchesBloom(block.Bloom) {
+			continue
+		}
+
+		for _, receipt := range block.Receipts {
+			if !self.matchesBloom(receipt.Bloom) {
+				continue
+			}
+
+			for _, log := range receipt.Logs {
+				if !self.matches(log) {
+					continue
+				}
+
+				if skipped < self.Skip {
+					skipped++
+					continue
+				}
+
+				logs = append(logs, log)
+				if self.Max > 0 && len(logs) >= self.Max {
+					self.setCache(logs)
+					return logs
+				}
+			}
+		}
+	}
+
+	self.setCache(logs)
+
+	return logs
+}
+
+func (self *Filter) setCache(logs []*Log) {
+	self.mu.Lock()
+	self.cached, self.dirty = logs, false
+	self.mu.Unlock()
+}
+
+// matchesBloom reports whether bloom could possibly contain a log matching
+// this filter's addresses and topics. A false here means the block or
+// receipt it belongs to can be skipped without inspecting its Logs.
+func (self *Filter) matchesBloom(bloom Bloom) bool {
+	if len(self.Addresses) > 0 {
+		match := false
+		for _, addr := range self.Addresses {
+			if bloom.Test(addr) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+
+	for _, group := range self.Topics {
+		if len(group) == 0 {
+			continue
+		}
+
+		match := false
+		for _, topic := range group {
+			if bloom.Test(topic) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matches reports whether log itself, rather than just its Bloom
+// contribution, satisfies this filter's addresses and topics.
+func (self *Filter) matches(log *Log) bool {
+	if len(self.Addresses) > 0 && !byteSliceIn(self.Addresses, log.Address) {
+		return false
+	}
+
+	for i, group := range self.Topics {
+		if len(group) == 0 {
+			continue
+		}
+		if i >= len(log.Topics) || !byteSliceIn(group, log.Topics[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func byteSliceIn(haystack [][]byte, needle []byte) bool {
+	for _, item := range haystack {
+		if bytes.Equal(item, needle) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func toAddresses(v interface{}) [][]byte {
+	switch it := v.(type) {
+	case string:
+		return [][]byte{ethutil.FromHex(it)}
+	case []interface{}:
+		addrs := make([][]byte, 0, len(it))
+		for _, item := range it {
+			if s, ok := item.(string); ok {
+				addrs = append(addrs, ethutil.FromHex(s))
+			}
+		}
+		return addrs
+	}
+
+	return nil
+}
+
+func toTopics(v interface{}) [][][]byte {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	topics := make([][][]byte, len(list))
+	for i, item := range list {
+		switch t := item.(type) {
+		case string:
+			topics[i] = [][]byte{ethutil.FromHex(t)}
+		case []interface{}:
+			group := make([][]byte, 0, len(t))
+			for _, sub := range t {
+				if s, ok := sub.(string); ok {
+					group = append(group, ethutil.FromHex(s))
+				}
+			}
+			topics[i] = group
+		}
+	}
+
+	return topics
+}
+
+func toInt64(v interface{}, def int64) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	case float64:
+		return int64(n)
+	}
+
+	return def
+}
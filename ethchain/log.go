@@ -0,0 +1,14 @@
+package ethchain
+
+// Log is a single entry emitted by the LOG0..LOG4 opcodes during contract
+// execution. Topics are indexed so a Filter can match on them without
+// decoding Data.
+type Log struct {
+	Address []byte
+	Topics  [][]byte
+	Data    []byte
+}
+
+func NewLog(address []byte, topics [][]byte, data []byte) *Log {
+	return &Log{Address: address, Topics: topics, Data: data}
+}
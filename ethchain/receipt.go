@@ -0,0 +1,29 @@
+package ethchain
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Receipt is the result of applying a single transaction to state: the
+// resulting state root, the total gas spent by the block up to and
+// including this transaction, the logs the transaction's execution emitted,
+// and the Bloom filter derived from those logs.
+type Receipt struct {
+	PostState         []byte
+	CumulativeGasUsed *big.Int
+	Bloom             Bloom
+	Logs              []*Log
+}
+
+func NewReceipt(postState []byte, cumulativeGasUsed *big.Int, logs []*Log) *Receipt {
+	receipt := &Receipt{PostState: postState, CumulativeGasUsed: cumulativeGasUsed, Logs: logs}
+	receipt.Bloom = CreateBloom(receipt)
+
+	return receipt
+}
+
+func (self *Receipt) String() string {
+	return fmt.Sprintf("Receipt{PostState: %x, CumulativeGasUsed: %v, Bloom: %x, Logs: %v}",
+		self.PostState, self.CumulativeGasUsed, self.Bloom, self.Logs)
+}
@@ -0,0 +1,26 @@
+package ethchain
+
+import "github.com/ethereum/eth-go/ethreact"
+
+// Reactor returns the event bus state changes are announced on, creating it
+// lazily so a State zero value remains usable on its own (mainly useful in
+// tests that don't care about events).
+func (self *State) Reactor() *ethreact.Reactor {
+	if self.reactor == nil {
+		self.reactor = ethreact.New()
+	}
+
+	return self.reactor
+}
+
+// NotifyNewBlock announces that block has become the new head of the
+// chain.
+func (self *State) NotifyNewBlock(block *Block) {
+	self.Reactor().Post("newBlock", block)
+}
+
+// NotifyReorg announces that the chain has reorganised away from oldBlock
+// in favour of newBlock.
+func (self *State) NotifyReorg(oldBlock, newBlock *Block) {
+	self.Reactor().Post("chainReorg", []*Block{oldBlock, newBlock})
+}
@@ -0,0 +1,93 @@
+package ethchain
+
+import "math/big"
+
+// Copy returns a StateObject whose balance, code and storage are
+// independent of self, so mutating either one afterwards doesn't affect
+// the other. Used by State.Snapshot to take a restore point that later
+// in-place storage writes can't silently invalidate.
+func (self *StateObject) Copy() *StateObject {
+	copy := *self
+	copy.Amount = new(big.Int).Set(self.Amount)
+	copy.script = append([]byte{}, self.script...)
+	if self.state != nil {
+		copy.state = self.state.Copy()
+	}
+
+	return &copy
+}
+
+// Snapshot captures the balance, nonce, code and storage of every
+// StateObject currently in state, plus which addresses existed at all, so
+// RevertTo can later undo any mutation made after this call. Every
+// StateObject is deep-copied via StateObject.Copy so later in-place
+// mutations of the live objects (in particular their storage trie) can't
+// reach back into the snapshot.
+func (self *State) Snapshot() int {
+	if self.snapshots == nil {
+		self.snapshots = make(map[int]map[string]*StateObject)
+	}
+
+	self.snapshotId++
+
+	objects := make(map[string]*StateObject, len(self.states))
+	for addr, obj := range self.states {
+		objects[addr] = obj.Copy()
+	}
+	self.snapshots[self.snapshotId] = objects
+
+	return self.snapshotId
+}
+
+// RevertTo restores every StateObject recorded by the Snapshot() call
+// identified by id to its balance, nonce, code and storage at that time,
+// and removes every account created since. Snapshots taken after id are
+// discarded; id itself stays valid so it can be reverted to more than once
+// (once for a failing nested Execution, again for the outer transaction
+// that wraps it).
+//
+// Restoring mutates the live StateObject in place rather than replacing
+// state.states' entry with the snapshotted pointer: a caller still holding
+// an earlier *StateObject from GetAccount (an outer Execution's sender or
+// receiver, say, across a nested call that reverted) must see the reverted
+// fields through that same pointer instead of being left pointing at an
+// object state.states no longer references.
+func (self *State) RevertTo(id int) {
+	objects, ok := self.snapshots[id]
+	if !ok {
+		return
+	}
+
+	for addr := range self.states {
+		if _, existed := objects[addr]; !existed {
+			delete(self.states, addr)
+		}
+	}
+
+	for addr, saved := range objects {
+		// Restore from a fresh copy so later in-place mutations of the live
+		// object can't reach back into the snapshot and spoil a second
+		// RevertTo(id).
+		restored := saved.Copy()
+
+		live, existed := self.states[addr]
+		if !existed {
+			self.states[addr] = restored
+			self.UpdateStateObject(restored)
+			continue
+		}
+
+		live.Amount = restored.Amount
+		live.Nonce = restored.Nonce
+		live.script = restored.script
+		live.state = restored.state
+
+		self.UpdateStateObject(live)
+	}
+
+	for snapId := range self.snapshots {
+		if snapId > id {
+			delete(self.snapshots, snapId)
+		}
+	}
+}
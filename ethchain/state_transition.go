@@ -14,10 +14,21 @@ type StateTransition struct {
 	block    *Block
 
 	cb, rec, sen *StateObject
+
+	logs []*Log
 }
 
 func NewStateTransition(coinbase []byte, tx *Transaction, state *State, block *Block) *StateTransition {
-	return &StateTransition{coinbase, tx, new(big.Int), state, block, nil, nil, nil}
+	return &StateTransition{coinbase, tx, new(big.Int), state, block, nil, nil, nil, nil}
+}
+
+// AddLog appends a Log emitted by the LOGn opcodes to this transaction's
+// log buffer. It ends up in the transaction's Receipt once TransitionState
+// finishes. StateTransition is handed to NewVm as the environment the VM
+// posts LOGn opcodes to, so this is reached however deep the CALL/CREATE
+// stack recurses, not just from the top-level Execution.
+func (self *StateTransition) AddLog(log *Log) {
+	self.logs = append(self.logs, log)
 }
 
 func (self *StateTransition) Coinbase() *StateObject {
@@ -49,17 +60,6 @@ func (self *StateTransition) Receiver() *StateObject {
 	return self.rec
 }
 
-func (self *StateTransition) MakeStateObject(state *State, tx *Transaction) *StateObject {
-	contract := MakeContract(tx, state)
-	if contract != nil {
-		state.states[string(tx.CreationAddress())] = contract.state
-
-		return contract
-	}
-
-	return nil
-}
-
 func (self *StateTransition) UseGas(amount *big.Int) error {
 	if self.gas.Cmp(amount) < 0 {
 		return OutOfGasError()
@@ -95,19 +95,36 @@ func (self *StateTransition) BuyGas() error {
 }
 
 func (self *StateTransition) TransitionState() (err error) {
-	//snapshot := st.state.Snapshot()
+	var (
+		snapshot int
+		applying bool
+	)
+
+	self.state.Reactor().Post("newTx:pre", self.tx)
 
 	defer func() {
 		if r := recover(); r != nil {
 			ethutil.Config.Log.Infoln(r)
 			err = fmt.Errorf("%v", r)
 		}
+
+		// A failure past this point still burns the gas that was bought
+		// and paid to the coinbase; only the transfer/contract-creation
+		// side effects of the transaction get rolled back.
+		if err != nil {
+			self.state.RevertTo(snapshot)
+		}
+
+		// Notify all subscribers, success or failure, now that the
+		// transaction has been fully applied (and possibly reverted).
+		if applying {
+			self.state.Reactor().Post("newTx:post", self.tx)
+		}
 	}()
 
 	var (
-		tx       = self.tx
-		sender   = self.Sender()
-		receiver *StateObject
+		tx     = self.tx
+		sender = self.Sender()
 	)
 
 	if sender.Nonce != tx.Nonce {
@@ -115,16 +132,16 @@ func (self *StateTransition) TransitionState() (err error) {
 	}
 
 	sender.Nonce += 1
-	defer func() {
-		// Notify all subscribers
-		//self.Ethereum.Reactor().Post("newTx:post", tx)
-	}()
+	applying = true
 
 	if err = self.BuyGas(); err != nil {
 		return err
 	}
 
-	receiver = self.Receiver()
+	// Gas has been bought and the coinbase paid; snapshot here so a later
+	// failure still leaves that payment in place and only undoes the
+	// transfer/contract-creation part of the transaction.
+	snapshot = self.state.Snapshot()
 
 	if err = self.UseGas(GasTx); err != nil {
 		return err
@@ -136,63 +153,51 @@ func (self *StateTransition) TransitionState() (err error) {
 		return err
 	}
 
-	if receiver == nil { // Contract
-		receiver = self.MakeStateObject(self.state, tx)
-		if receiver == nil {
-			return fmt.Errorf("ERR. Unable to create contract with transaction %v", tx)
-		}
-	}
-
-	if err = self.transferValue(sender, receiver); err != nil {
-		return err
+	// tx.CreationAddress() derives the new contract's address from the
+	// transaction itself rather than the sender's live (already bumped,
+	// above) nonce, so Execution.Create doesn't need to re-derive it.
+	address := tx.Recipient
+	if tx.CreatesContract() {
+		address = tx.CreationAddress()
 	}
 
+	execution := NewExecution(self.VM(), address, tx.Data, self.gas, tx.GasPrice, tx.Value)
 	if tx.CreatesContract() {
-		fmt.Println(Disassemble(receiver.Init()))
-		// Evaluate the initialization script
-		// and use the return value as the
-		// script section for the state object.
-		//script, gas, err = sm.Eval(state, contract.Init(), contract, tx, block)
-		code, err := self.Eval(receiver.Init(), receiver)
-		if err != nil {
-			return fmt.Errorf("Error during init script run %v", err)
-		}
-
-		receiver.script = code
+		_, err = execution.Create(sender)
+	} else {
+		_, err = execution.Call(sender)
+	}
+	if err != nil {
+		return err
 	}
 
 	self.state.UpdateStateObject(sender)
-	self.state.UpdateStateObject(receiver)
 
-	return nil
-}
-
-func (self *StateTransition) transferValue(sender, receiver *StateObject) error {
-	if sender.Amount.Cmp(self.tx.Value) < 0 {
-		return fmt.Errorf("Insufficient funds to transfer value. Req %v, has %v", self.tx.Value, sender.Amount)
+	gasUsed := new(big.Int).Sub(tx.Gas, self.gas)
+	cumulativeGasUsed := new(big.Int).Set(gasUsed)
+	if n := len(self.block.Receipts); n > 0 {
+		cumulativeGasUsed.Add(cumulativeGasUsed, self.block.Receipts[n-1].CumulativeGasUsed)
 	}
 
-	// Subtract the amount from the senders account
-	sender.SubAmount(self.tx.Value)
-	// Add the amount to receivers account which should conclude this transaction
-	receiver.AddAmount(self.tx.Value)
-
-	ethutil.Config.Log.Debugf("%x => %x (%v) %x\n", sender.Address()[:4], receiver.Address()[:4], self.tx.Value, self.tx.Hash())
+	receipt := NewReceipt(self.state.Root(), cumulativeGasUsed, self.logs)
+	self.block.Receipts = append(self.block.Receipts, receipt)
+	self.block.Bloom.Or(receipt.Bloom)
 
 	return nil
 }
 
-func (self *StateTransition) Eval(script []byte, context *StateObject) (ret []byte, err error) {
-	var (
-		tx        = self.tx
-		block     = self.block
-		initiator = self.Sender()
-		state     = self.state
-	)
-
-	closure := NewClosure(initiator, context, script, state, self.gas, tx.GasPrice)
-	vm := NewVm(state, nil, RuntimeVars{
-		Origin:      initiator.Address(),
+// VM builds the runtime a top-level transaction (or, via Execution, a
+// nested CALL/CREATE) executes its code against. self is passed as the
+// environment so LOGn opcodes reach this transaction's AddLog no matter how
+// deep the call stack recurses: Execution always runs against the same *Vm
+// it was handed rather than building a fresh one, so a nested CALL/CREATE
+// logs to the same buffer as the top-level transaction.
+func (self *StateTransition) VM() *Vm {
+	tx := self.tx
+	block := self.block
+
+	return NewVm(self.state, self, RuntimeVars{
+		Origin:      self.Sender().Address(),
 		BlockNumber: block.BlockInfo().Number,
 		PrevHash:    block.PrevHash,
 		Coinbase:    block.Coinbase,
@@ -200,7 +205,4 @@ func (self *StateTransition) Eval(script []byte, context *StateObject) (ret []by
 		Diff:        block.Difficulty,
 		Value:       tx.Value,
 	})
-	ret, _, err = closure.Call(vm, tx.Data, nil)
-
-	return
 }
\ No newline at end of file
@@ -0,0 +1,141 @@
+// Package ethreact provides a small publish/subscribe event bus used to
+// decouple state changes (new transactions, new blocks, chain reorgs, peer
+// disconnects, ...) from the code that wants to react to them, such as log
+// filters, JSON-RPC subscriptions or the miner's tx pool.
+package ethreact
+
+import "sync"
+
+// Event is delivered to every subscriber of the name it was Post'ed under.
+// Resource carries whatever value was passed to Post.
+type Event struct {
+	Name     string
+	Resource interface{}
+}
+
+// Subscription is returned by Reactor.Subscribe and lets the caller stop
+// receiving events on the channel it was given without having to remember
+// which event name it subscribed to.
+type Subscription struct {
+	ch    chan<- Event
+	event string
+	react *Reactor
+}
+
+// Unsubscribe removes this subscription from its Reactor. The channel is
+// not closed; it is simply no longer written to.
+func (self *Subscription) Unsubscribe() {
+	self.react.Unsubscribe(self.event, self.ch)
+}
+
+type postedEvent struct {
+	name string
+	data interface{}
+}
+
+// Reactor fans events posted with Post out to every channel subscribed to
+// that event name. Posting never blocks on a subscriber: a subscriber whose
+// channel is full simply has the event dropped for it, and the number of
+// drops is counted so a slow consumer can be noticed and dealt with.
+type Reactor struct {
+	mu          sync.Mutex
+	subscribers map[string][]chan<- Event
+	dropped     map[chan<- Event]int
+
+	postCh chan postedEvent
+	quit   chan struct{}
+}
+
+// New creates a Reactor and starts its dispatch loop. Call Stop to shut it
+// down.
+func New() *Reactor {
+	reactor := &Reactor{
+		subscribers: make(map[string][]chan<- Event),
+		dropped:     make(map[chan<- Event]int),
+		postCh:      make(chan postedEvent, 256),
+		quit:        make(chan struct{}),
+	}
+	go reactor.loop()
+
+	return reactor
+}
+
+// Stop terminates the dispatch goroutine. A Reactor can't be restarted
+// after Stop.
+func (self *Reactor) Stop() {
+	close(self.quit)
+}
+
+func (self *Reactor) loop() {
+	for {
+		select {
+		case ev := <-self.postCh:
+			self.dispatch(ev)
+		case <-self.quit:
+			return
+		}
+	}
+}
+
+func (self *Reactor) dispatch(ev postedEvent) {
+	self.mu.Lock()
+	// Copy the slice under the lock so we can send outside it; Subscribe
+	// may run concurrently with dispatch.
+	subs := make([]chan<- Event, len(self.subscribers[ev.name]))
+	copy(subs, self.subscribers[ev.name])
+	self.mu.Unlock()
+
+	event := Event{Name: ev.name, Resource: ev.data}
+	for _, ch := range subs {
+		select {
+		case ch <- event:
+		default:
+			self.mu.Lock()
+			self.dropped[ch]++
+			self.mu.Unlock()
+		}
+	}
+}
+
+// Post asynchronously fans event out to every subscriber of that name. It
+// never blocks on a slow subscriber.
+func (self *Reactor) Post(event string, data interface{}) {
+	self.postCh <- postedEvent{name: event, data: data}
+}
+
+// Subscribe registers ch to receive every event posted under name, until
+// Unsubscribe (or the returned Subscription's Unsubscribe) is called. ch
+// should be buffered; an unbuffered channel drops every event unless a
+// reader is ready for it the instant it's posted.
+func (self *Reactor) Subscribe(event string, ch chan<- Event) Subscription {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.subscribers[event] = append(self.subscribers[event], ch)
+
+	return Subscription{ch: ch, event: event, react: self}
+}
+
+// Unsubscribe removes ch from the list of subscribers for event.
+func (self *Reactor) Unsubscribe(event string, ch chan<- Event) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	subs := self.subscribers[event]
+	for i, c := range subs {
+		if c == ch {
+			self.subscribers[event] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	delete(self.dropped, ch)
+}
+
+// Dropped returns how many events posted while ch's buffer was full have
+// been dropped for it.
+func (self *Reactor) Dropped(ch chan<- Event) int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.dropped[ch]
+}
@@ -0,0 +1,42 @@
+package ethwire
+
+// DiscReason is sent as the single byte payload of a MsgDiscTy message to
+// tell the remote peer (and our own peer manager) why a connection is
+// being closed, so the manager can decide whether it's worth retrying.
+type DiscReason byte
+
+const (
+	DiscReasonBadProtocol DiscReason = iota
+	DiscReasonUselessPeer
+	DiscReasonTooManyPeers
+	DiscReasonAlreadyConnected
+	DiscReasonWrongGenesis
+	DiscReasonIncompatibleVersion
+	DiscReasonTimeout
+	DiscReasonClientQuit
+)
+
+var discReasonToString = map[DiscReason]string{
+	DiscReasonBadProtocol:         "bad protocol",
+	DiscReasonUselessPeer:         "useless peer",
+	DiscReasonTooManyPeers:        "too many peers",
+	DiscReasonAlreadyConnected:    "already connected",
+	DiscReasonWrongGenesis:        "wrong genesis block",
+	DiscReasonIncompatibleVersion: "incompatible network protocol version",
+	DiscReasonTimeout:             "timeout",
+	DiscReasonClientQuit:          "client quitting",
+}
+
+func (self DiscReason) String() string {
+	if reason, ok := discReasonToString[self]; ok {
+		return reason
+	}
+
+	return "unknown disconnect reason"
+}
+
+// RlpValue lets a DiscReason be passed directly to Connection.Write as the
+// single byte payload of a MsgDiscTy message.
+func (self DiscReason) RlpValue() []interface{} {
+	return []interface{}{byte(self)}
+}
@@ -3,24 +3,38 @@
 package ethwire
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/ethereum/eth-go/ethreact"
 	"github.com/ethereum/eth-go/ethutil"
 )
 
+// pingInterval is both how often a live Connection pings its peer and the
+// unit two consecutive missed pongs are measured in before the connection
+// is considered dead.
+const pingInterval = 30 * time.Second
+
 // Connection interface describing the methods required to implement the wire protocol.
 type Conn interface {
 	Write(typ MsgType, v ...interface{}) error
-	Read() *Msg
+	Read() (*Msg, error)
 }
 
 // The magic token which should be the first 4 bytes of every message and can be used as separator between messages.
 var MagicToken = []byte{34, 64, 8, 145}
 
+// Messages larger than this are treated as a corrupt length field rather
+// than a real frame, so a single garbled message can't make us try to
+// buffer an enormous "payload" before noticing something is wrong.
+const maxMessageSize = 10 * 1024 * 1024
+
 type MsgType byte
 
 const (
@@ -81,151 +95,279 @@ type Messages []*Msg
 // The Connection object takes care of all encoding and sending objects properly over
 // the network.
 type Connection struct {
-	conn            net.Conn
-	nTimeout        time.Duration
-	pendingMessages Messages
+	conn    net.Conn
+	r       *bufio.Reader
+	reactor *ethreact.Reactor
+
+	outbound  chan outboundMsg
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	// writeMu serialises every actual write to conn, whether it comes from
+	// writeLoop (the normal path once Start has been called) or from
+	// Disconnect being called directly by another goroutine, so two
+	// writers can never interleave partial frames on the wire.
+	writeMu sync.Mutex
+
+	// mu guards lastPong and discReason, which are written from the Read
+	// goroutine and read from both writeLoop and any caller of DiscReason.
+	mu         sync.Mutex
+	lastPong   time.Time
+	discReason *DiscReason
+}
+
+type outboundMsg struct {
+	typ  MsgType
+	args []interface{}
 }
 
 // Create a new connection to the Ethereum network
 func New(conn net.Conn) *Connection {
-	return &Connection{conn: conn, nTimeout: 500}
+	return &Connection{conn: conn, r: bufio.NewReader(conn)}
 }
 
-// Read, reads from the network. It will block until the next message is received.
-func (self *Connection) Read() *Msg {
-	if len(self.pendingMessages) == 0 {
-		self.readMessages()
-	}
+// SetReactor attaches the event bus peer:disconnect (and future liveness
+// events) are posted to. A Connection works fine without one; events are
+// simply not published.
+func (self *Connection) SetReactor(reactor *ethreact.Reactor) {
+	self.reactor = reactor
+}
+
+// Start spawns the writer goroutine that serialises every Write onto the
+// wire and drives ping/pong liveness: a MsgPingTy is sent every
+// pingInterval, and if two of them in a row elapse with no MsgPongTy seen
+// on the Read() path, the connection is closed with DiscReasonTimeout.
+// Connections that never call Start still work, they simply write
+// synchronously and never ping.
+func (self *Connection) Start() {
+	self.outbound = make(chan outboundMsg, 16)
+	self.quit = make(chan struct{})
+	self.setLastPong(time.Now())
+
+	go self.writeLoop()
+}
 
-	ret := self.pendingMessages[0]
-	self.pendingMessages = self.pendingMessages[1:]
+func (self *Connection) setLastPong(t time.Time) {
+	self.mu.Lock()
+	self.lastPong = t
+	self.mu.Unlock()
+}
 
-	return ret
+func (self *Connection) sinceLastPong() time.Duration {
+	self.mu.Lock()
+	defer self.mu.Unlock()
 
+	return time.Since(self.lastPong)
 }
 
-// Write to the Ethereum network specifying the type of the message and
-// the data. Data can be of type RlpEncodable or []interface{}. Returns
-// nil or if something went wrong an error.
-func (self *Connection) Write(typ MsgType, v ...interface{}) error {
-	var pack []byte
+func (self *Connection) setDiscReason(reason DiscReason) {
+	self.mu.Lock()
+	self.discReason = &reason
+	self.mu.Unlock()
+}
 
-	slice := [][]interface{}{[]interface{}{byte(typ)}}
-	for _, value := range v {
-		if encodable, ok := value.(ethutil.RlpEncodeDecode); ok {
-			slice = append(slice, encodable.RlpValue())
-		} else if raw, ok := value.([]interface{}); ok {
-			slice = append(slice, raw)
-		} else {
-			panic(fmt.Sprintf("Unable to 'write' object of type %T", value))
+func (self *Connection) writeLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	missedPongs := 0
+	for {
+		select {
+		case msg, ok := <-self.outbound:
+			if !ok {
+				return
+			}
+			if err := self.write(msg.typ, msg.args...); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			if self.sinceLastPong() > pingInterval {
+				missedPongs++
+				if missedPongs >= 2 {
+					self.Disconnect(DiscReasonTimeout)
+					return
+				}
+			} else {
+				missedPongs = 0
+			}
+			self.write(MsgPingTy)
+
+		case <-self.quit:
+			return
 		}
 	}
+}
 
-	// Encode the type and the (RLP encoded) data for sending over the wire
-	encoded := ethutil.NewValue(slice).Encode()
-	payloadLength := ethutil.NumberToBytes(uint32(len(encoded)), 32)
+// Disconnect sends a MsgDiscTy carrying reason as its single byte payload
+// and closes the underlying connection. It can safely be called from any
+// goroutine, including concurrently with writeLoop: self.write takes
+// writeMu itself, so this can't interleave its frame with one of
+// writeLoop's pings on the wire, and closeOnce means it's harmless for
+// Disconnect to race the writeLoop timeout path that also calls it.
+func (self *Connection) Disconnect(reason DiscReason) {
+	self.write(MsgDiscTy, reason)
+	self.conn.Close()
+
+	self.closeOnce.Do(func() {
+		if self.quit != nil {
+			close(self.quit)
+		}
+	})
 
-	// Write magic token and payload length (first 8 bytes)
-	pack = append(MagicToken, payloadLength...)
-	pack = append(pack, encoded...)
+	self.notifyDisconnect(reason)
+}
 
-	// Write to the connection
-	_, err := self.conn.Write(pack)
-	if err != nil {
-		return err
+// DiscReason returns the reason the remote peer gave for disconnecting, if
+// a MsgDiscTy has been seen on the Read() path.
+func (self *Connection) DiscReason() (DiscReason, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.discReason == nil {
+		return 0, false
 	}
 
-	return nil
+	return *self.discReason, true
 }
 
-func (self *Connection) readMessage(data []byte) (msg *Msg, remaining []byte, done bool, err error) {
-	if len(data) == 0 {
-		return nil, nil, true, nil
-	}
+// Read blocks until the next framed message has arrived on the connection
+// and returns it, or returns the error (including io.EOF) that prevented
+// that. Unlike the old deadline-based batch reader, a single call to Read
+// never returns more or less than one message, and a message split across
+// several TCP reads is simply read across as many conn.Read calls as it
+// takes.
+func (self *Connection) Read() (*Msg, error) {
+	for {
+		if err := self.syncToken(); err != nil {
+			self.notifyDisconnect(err)
+			return nil, err
+		}
 
-	if len(data) <= 8 {
-		return nil, remaining, false, errors.New("Invalid message")
-	}
+		lengthBytes := make([]byte, 4)
+		if _, err := io.ReadFull(self.r, lengthBytes); err != nil {
+			self.notifyDisconnect(err)
+			return nil, err
+		}
 
-	// Check if the received 4 first bytes are the magic token
-	if bytes.Compare(MagicToken, data[:4]) != 0 {
-		return nil, nil, false, fmt.Errorf("MagicToken mismatch. Received %v", data[:4])
-	}
+		length := ethutil.BytesToNumber(lengthBytes)
+		if length > maxMessageSize {
+			// Not a real frame; most likely we're out of sync. Fall back
+			// to scanning for the next MagicToken rather than trying to
+			// buffer (or reject outright and kill the connection over) a
+			// bogus length field.
+			continue
+		}
 
-	messageLength := ethutil.BytesToNumber(data[4:8])
-	remaining = data[8+messageLength:]
-	if int(messageLength) > len(data[8:]) {
-		return nil, nil, false, fmt.Errorf("message length %d, expected %d", len(data[8:]), messageLength)
-	}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(self.r, payload); err != nil {
+			self.notifyDisconnect(err)
+			return nil, err
+		}
 
-	message := data[8 : 8+messageLength]
-	decoder := ethutil.NewValueFromBytes(message)
-	// Type of message
-	t := decoder.Get(0).Uint()
-	// Actual data
-	d := decoder.SliceFrom(1)
+		decoder := ethutil.NewValueFromBytes(payload)
+		msg := &Msg{
+			Type: MsgType(decoder.Get(0).Uint()),
+			Data: decoder.SliceFrom(1),
+		}
 
-	msg = &Msg{
-		Type: MsgType(t),
-		Data: d,
+		switch msg.Type {
+		case MsgPongTy:
+			self.setLastPong(time.Now())
+		case MsgDiscTy:
+			reason := DiscReason(msg.Data.Get(0).Uint())
+			self.setDiscReason(reason)
+			self.notifyDisconnect(reason)
+		}
+
+		return msg, nil
 	}
+}
 
-	return
+// notifyDisconnect announces why this connection is going away, if a
+// Reactor has been attached. reason is either the error that broke the
+// read loop (typically io.EOF or a closed/reset connection) or, once a
+// MsgDiscTy has been seen or sent, the DiscReason it carried.
+func (self *Connection) notifyDisconnect(reason interface{}) {
+	if self.reactor != nil {
+		self.reactor.Post("peer:disconnect", reason)
+	}
 }
 
-// The basic message reader waits for data on the given connection, decoding
-// and doing a few sanity checks such as if there's a data type and
-// unmarhals the given data
-func (self *Connection) readMessages() (err error) {
-	// The recovering function in case anything goes horribly wrong
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("ethwire.ReadMessage error: %v", r)
-		}
-	}()
+// syncToken reads from the connection until MagicToken has been seen,
+// sliding a 4 byte window one byte at a time when it hasn't, so a single
+// corrupt payload leaves us resynchronised on the next message instead of
+// killing the connection.
+func (self *Connection) syncToken() error {
+	token := make([]byte, len(MagicToken))
+	if _, err := io.ReadFull(self.r, token); err != nil {
+		return err
+	}
 
-	// Buff for writing network message to
-	//buff := make([]byte, 1440)
-	var buff []byte
-	var totalBytes int
-	for {
-		// Give buffering some time
-		self.conn.SetReadDeadline(time.Now().Add(self.nTimeout * time.Millisecond))
-		// Create a new temporarily buffer
-		b := make([]byte, 1440)
-		// Wait for a message from this peer
-		n, _ := self.conn.Read(b)
-		if err != nil && n == 0 {
-			if err.Error() != "EOF" {
-				fmt.Println("err now", err)
-				return err
-			} else {
-				break
-			}
+	for !bytes.Equal(token, MagicToken) {
+		copy(token, token[1:])
 
-			// Messages can't be empty
-		} else if n == 0 {
-			break
+		b, err := self.r.ReadByte()
+		if err != nil {
+			return err
 		}
+		token[len(token)-1] = b
+	}
+
+	return nil
+}
 
-		buff = append(buff, b[:n]...)
-		totalBytes += n
+// Write to the Ethereum network specifying the type of the message and
+// the data. Data can be of type RlpEncodable or []interface{}. Returns nil
+// or if something went wrong an error. If Start has been called, the
+// actual write happens on the writer goroutine (interleaved with pings);
+// either way, write's own writeMu means callers from different goroutines
+// (including a directly-called Disconnect) can't race each other onto the
+// wire.
+func (self *Connection) Write(typ MsgType, v ...interface{}) error {
+	if self.outbound != nil {
+		self.outbound <- outboundMsg{typ, v}
+		return nil
 	}
 
-	// Reslice buffer
-	buff = buff[:totalBytes]
-	msg, remaining, done, err := self.readMessage(buff)
-	for ; done != true; msg, remaining, done, err = self.readMessage(remaining) {
-		//log.Println("rx", msg)
+	return self.write(typ, v...)
+}
+
+func (self *Connection) write(typ MsgType, v ...interface{}) error {
+	var pack []byte
 
-		if msg != nil {
-			self.pendingMessages = append(self.pendingMessages, msg)
+	slice := [][]interface{}{[]interface{}{byte(typ)}}
+	for _, value := range v {
+		if encodable, ok := value.(ethutil.RlpEncodeDecode); ok {
+			slice = append(slice, encodable.RlpValue())
+		} else if raw, ok := value.([]interface{}); ok {
+			slice = append(slice, raw)
+		} else {
+			panic(fmt.Sprintf("Unable to 'write' object of type %T", value))
 		}
 	}
 
-	return
+	// Encode the type and the (RLP encoded) data for sending over the wire
+	encoded := ethutil.NewValue(slice).Encode()
+	payloadLength := ethutil.NumberToBytes(uint32(len(encoded)), 32)
+
+	// Write magic token and payload length (first 8 bytes)
+	pack = append(MagicToken, payloadLength...)
+	pack = append(pack, encoded...)
+
+	// Serialise the actual conn.Write against any other goroutine writing
+	// at the same time (writeLoop's pings, or a directly-called Disconnect).
+	self.writeMu.Lock()
+	_, err := self.conn.Write(pack)
+	self.writeMu.Unlock()
+
+	return err
 }
 
+// ReadMessage decodes a single length-prefixed message from the front of
+// data and returns the bytes following it. It is the pure, buffer-based
+// counterpart to Connection.Read and is useful for re-decoding messages
+// that have already been read into memory by other means.
 func ReadMessage(data []byte) (msg *Msg, remaining []byte, done bool, err error) {
 	if len(data) == 0 {
 		return nil, nil, true, nil
@@ -261,63 +403,6 @@ func ReadMessage(data []byte) (msg *Msg, remaining []byte, done bool, err error)
 	return
 }
 
-func bufferedRead(conn net.Conn) ([]byte, error) {
-	return nil, nil
-}
-
-// The basic message reader waits for data on the given connection, decoding
-// and doing a few sanity checks such as if there's a data type and
-// unmarhals the given data
-func ReadMessages(conn net.Conn) (msgs []*Msg, err error) {
-	// The recovering function in case anything goes horribly wrong
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("ethwire.ReadMessage error: %v", r)
-		}
-	}()
-
-	// Buff for writing network message to
-	//buff := make([]byte, 1440)
-	var buff []byte
-	var totalBytes int
-	for {
-		// Give buffering some time
-		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-		// Create a new temporarily buffer
-		b := make([]byte, 1440)
-		// Wait for a message from this peer
-		n, _ := conn.Read(b)
-		if err != nil && n == 0 {
-			if err.Error() != "EOF" {
-				fmt.Println("err now", err)
-				return nil, err
-			} else {
-				break
-			}
-
-			// Messages can't be empty
-		} else if n == 0 {
-			break
-		}
-
-		buff = append(buff, b[:n]...)
-		totalBytes += n
-	}
-
-	// Reslice buffer
-	buff = buff[:totalBytes]
-	msg, remaining, done, err := ReadMessage(buff)
-	for ; done != true; msg, remaining, done, err = ReadMessage(remaining) {
-		//log.Println("rx", msg)
-
-		if msg != nil {
-			msgs = append(msgs, msg)
-		}
-	}
-
-	return
-}
-
 // The basic message writer takes care of writing data over the given
 // connection and does some basic error checking
 func WriteMessage(conn net.Conn, msg *Msg) error {
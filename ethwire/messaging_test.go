@@ -0,0 +1,182 @@
+package ethwire
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ethereum/eth-go/ethutil"
+)
+
+// fakeConn is a minimal net.Conn backed by a fixed byte slice, fed to
+// Connection.Read in arbitrarily small chunks so the framing logic has to
+// cope with reads that split tokens, length fields and payloads across
+// multiple underlying Read calls.
+type fakeConn struct {
+	net.Conn
+	r        *bytes.Reader
+	chunk    int
+	numReads int
+}
+
+func newFakeConn(data []byte, chunk int) *fakeConn {
+	return &fakeConn{r: bytes.NewReader(data), chunk: chunk}
+}
+
+func (self *fakeConn) Read(p []byte) (int, error) {
+	self.numReads++
+
+	max := self.chunk
+	if max <= 0 || max > len(p) {
+		max = len(p)
+	}
+
+	return self.r.Read(p[:max])
+}
+
+func (self *fakeConn) Write(p []byte) (int, error) { return len(p), nil }
+func (self *fakeConn) Close() error                { return nil }
+
+func frame(msgType MsgType, payload []interface{}) []byte {
+	slice := [][]interface{}{[]interface{}{byte(msgType)}, payload}
+	encoded := ethutil.NewValue(slice).Encode()
+	length := ethutil.NumberToBytes(uint32(len(encoded)), 32)
+
+	packet := append([]byte{}, MagicToken...)
+	packet = append(packet, length...)
+	packet = append(packet, encoded...)
+
+	return packet
+}
+
+// TestReadSplitAcrossManyReads feeds a single well-formed frame to Read one
+// byte at a time, covering both a short read on the magic token and one on
+// the length field and payload.
+func TestReadSplitAcrossManyReads(t *testing.T) {
+	packet := frame(MsgPingTy, nil)
+	conn := newFakeConn(packet, 1)
+	c := New(conn)
+
+	msg, err := c.Read()
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if msg.Type != MsgPingTy {
+		t.Fatalf("Type = %v, want %v", msg.Type, MsgPingTy)
+	}
+	if conn.numReads <= 1 {
+		t.Fatalf("expected the fake conn to be read from in more than one chunk")
+	}
+}
+
+// TestReadOversizeLengthResyncs feeds a frame whose length field claims a
+// payload far bigger than maxMessageSize, followed by a genuine frame, and
+// checks Read skips the bogus one by resyncing on the next MagicToken
+// instead of trying to buffer (or blocking forever on) the bogus payload.
+func TestReadOversizeLengthResyncs(t *testing.T) {
+	bogus := append([]byte{}, MagicToken...)
+	bogus = append(bogus, ethutil.NumberToBytes(uint32(maxMessageSize+1), 32)...)
+
+	good := frame(MsgPongTy, nil)
+
+	conn := newFakeConn(append(bogus, good...), 0)
+	c := New(conn)
+
+	msg, err := c.Read()
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if msg.Type != MsgPongTy {
+		t.Fatalf("Type = %v, want %v", msg.Type, MsgPongTy)
+	}
+}
+
+// TestReadInterleavedGarbageResyncs plants garbage bytes (that happen to
+// contain no MagicToken) ahead of a real frame and checks syncToken slides
+// its window past them instead of misreading them as a frame.
+func TestReadInterleavedGarbageResyncs(t *testing.T) {
+	garbage := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	good := frame(MsgGetPeersTy, nil)
+
+	conn := newFakeConn(append(garbage, good...), 3)
+	c := New(conn)
+
+	msg, err := c.Read()
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if msg.Type != MsgGetPeersTy {
+		t.Fatalf("Type = %v, want %v", msg.Type, MsgGetPeersTy)
+	}
+}
+
+// TestReadShortConnReturnsEOF checks a connection that closes mid-frame
+// surfaces io.EOF (or io.ErrUnexpectedEOF) rather than hanging or panicking.
+func TestReadShortConnReturnsEOF(t *testing.T) {
+	packet := frame(MsgBlockTy, nil)
+	conn := newFakeConn(packet[:len(packet)-2], 0)
+	c := New(conn)
+
+	if _, err := c.Read(); err != io.EOF && err != io.ErrUnexpectedEOF {
+		t.Fatalf("Read() error = %v, want io.EOF or io.ErrUnexpectedEOF for a truncated frame", err)
+	}
+}
+
+// TestDiscReasonFromSplitFrame exercises the MsgDiscTy branch of Read
+// specifically, since it's the one path that also mutates discReason.
+func TestDiscReasonFromSplitFrame(t *testing.T) {
+	packet := frame(MsgDiscTy, []interface{}{byte(DiscReasonTimeout)})
+	conn := newFakeConn(packet, 2)
+	c := New(conn)
+
+	if _, err := c.Read(); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	reason, ok := c.DiscReason()
+	if !ok {
+		t.Fatalf("DiscReason() ok = false, want true")
+	}
+	if reason != DiscReasonTimeout {
+		t.Fatalf("DiscReason() = %v, want %v", reason, DiscReasonTimeout)
+	}
+}
+
+// TestPongUpdatesLastPongConcurrently drives Read (as the reader goroutine
+// would) and DiscReason/the ping ticker's lastPong check (as writeLoop
+// would) concurrently, under -race, to guard against the data race on
+// lastPong/discReason this test was written to catch.
+func TestPongUpdatesLastPongConcurrently(t *testing.T) {
+	var packets []byte
+	for i := 0; i < 50; i++ {
+		packets = append(packets, frame(MsgPongTy, nil)...)
+	}
+
+	conn := newFakeConn(packets, 0)
+	c := New(conn)
+	c.Start()
+	defer close(c.quit)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if _, err := c.Read(); err == io.EOF {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		c.DiscReason()
+		c.sinceLastPong()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for reader goroutine")
+	}
+}